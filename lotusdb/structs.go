@@ -1,13 +1,8 @@
 package lotusdb
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	dwal "dwal"
 	"encoding/binary"
-	"encoding/hex"
-	"io"
 )
 
 // LogRecordType is the type of the log record.
@@ -111,7 +106,11 @@ type ValueLogRecord struct {
 	value []byte
 }
 
-func encodeValueLogRecord(record *ValueLogRecord) ([]byte, []byte) {
+// encodeValueLogRecord frames a key/value pair for the value log. Actual
+// encryption at rest, if any, is handled transparently by the wal.Cipher
+// configured on the underlying WAL, so this only needs to frame the
+// plaintext.
+func encodeValueLogRecord(record *ValueLogRecord) []byte {
 	buf := make([]byte, 4+len(record.key)+len(record.value))
 	keySize := 4
 	index := 0
@@ -122,39 +121,10 @@ func encodeValueLogRecord(record *ValueLogRecord) ([]byte, []byte) {
 	index += len(record.key)
 	copy(buf[index:], record.value)
 
-	aes_key, _ := hex.DecodeString("6368616e676520746869732070617373776f726420746f206120736563726574")
-	block, err := aes.NewCipher(aes_key)
-	if err != nil {
-		panic(err.Error())
-	}
-	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
-	}
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		panic(err.Error())
-	}
-	buf_enc := aesgcm.Seal(nil, nonce, buf, nil)
-	return buf_enc, nonce
+	return buf
 }
 
-func decodeValueLogRecord(buf_enc []byte, nonce []byte) *ValueLogRecord {
-	aes_key, _ := hex.DecodeString("6368616e676520746869732070617373776f726420746f206120736563726574")
-	block, err := aes.NewCipher(aes_key)
-	if err != nil {
-		panic(err.Error())
-	}
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		panic(err.Error())
-	}
-	buf, err := aesgcm.Open(nil, nonce, buf_enc, nil)
-	if err != nil {
-		panic(err.Error())
-	}
-
+func decodeValueLogRecord(buf []byte) *ValueLogRecord {
 	var keySize uint32 = 4
 	keyLen := binary.LittleEndian.Uint32(buf[:keySize])
 	key := make([]byte, keyLen)
@@ -3,6 +3,7 @@ package lotusdb
 import (
 	"context"
 	"fmt"
+	"time"
 
 	dwal "dwal"
 
@@ -25,9 +26,6 @@ type valueLogOptions struct {
 	// dirPath specifies the directory path where the WAL segment files will be stored.
 	dirPath string
 
-	// nonceDirPath specifies the directory path where the WAL nonce segment files will be stored.
-	nonceDirPath string
-
 	// segmentSize specifies the maximum size of each segment file in bytes.
 	segmentSize int64
 
@@ -39,6 +37,24 @@ type valueLogOptions struct {
 
 	// writing validEntries to disk after reading the specified number of entries.
 	compactBatchCount int
+
+	// cipher, when set, is plumbed into every partition's WAL so value log
+	// records are encrypted at rest. Leave nil to store values as
+	// plaintext.
+	cipher dwal.Cipher
+
+	// compression, when set, is plumbed into every partition's WAL so
+	// value log records are compressed before they are written (and, if
+	// cipher is also set, before they are sealed). Leave at
+	// dwal.CompressionNone to store values uncompressed.
+	compression dwal.CompressionType
+
+	// groupCommitInterval and maxGroupCommitBatch are plumbed into every
+	// partition's WAL to bound how long writeBatch's concurrent per-record
+	// writes wait on each other before a partition commits. Leave at zero
+	// to let each write fsync as soon as it's the only one pending.
+	groupCommitInterval time.Duration
+	maxGroupCommitBatch int
 }
 
 // open wal files for value log, it will open several wal files for concurrent writing and reading
@@ -48,12 +64,14 @@ func openValueLog(options valueLogOptions) (*valueLog, error) {
 
 	for i := 0; i < int(options.partitionNum); i++ {
 		vLogWal, err := dwal.Open(dwal.Options{
-			DirPath:        options.dirPath,
-			NonceDirPath:   options.nonceDirPath,
-			SegmentSize:    options.segmentSize,
-			SegmentFileExt: fmt.Sprintf(valueLogFileExt, i),
-			Sync:           false, // we will sync manually
-			BytesPerSync:   0,     // the same as Sync
+			DirPath:             options.dirPath,
+			SegmentSize:         options.segmentSize,
+			SegmentFileExt:      fmt.Sprintf(valueLogFileExt, i),
+			Sync:                true, // writeBatch relies on WriteConcurrent to fsync, not a manual step afterwards
+			Cipher:              options.cipher,
+			Compression:         options.compression,
+			GroupCommitInterval: options.groupCommitInterval,
+			MaxGroupCommitBatch: options.maxGroupCommitBatch,
 		})
 		if err != nil {
 			return nil, err
@@ -66,11 +84,11 @@ func openValueLog(options valueLogOptions) (*valueLog, error) {
 
 // read the value log record from the specified position.
 func (vlog *valueLog) read(pos *KeyPosition) (*ValueLogRecord, error) {
-	buf, nonce, err := vlog.walFiles[pos.partition].Read(pos.position)
+	buf, err := vlog.walFiles[pos.partition].Read(pos.position)
 	if err != nil {
 		return nil, err
 	}
-	log := decodeValueLogRecord(buf, nonce)
+	log := decodeValueLogRecord(buf)
 	return log, nil
 }
 
@@ -94,35 +112,33 @@ func (vlog *valueLog) writeBatch(records []*ValueLogRecord) ([]*KeyPosition, err
 
 		part := i
 		g.Go(func() error {
-			var err error
-			defer func() {
-				if err != nil {
-					vlog.walFiles[part].ClearPendingWrites()
-				}
-			}()
-
-			var keyPositions []*KeyPosition
-			writeIdx := 0
-			for _, record := range partitionRecords[part] {
-				select {
-				case <-ctx.Done():
-					err = ctx.Err()
-					return err
-				default:
-					enc_buf, nonce := encodeValueLogRecord(record)
-					vlog.walFiles[part].PendingWrites(enc_buf, nonce)
-				}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
 			}
-			positions, err := vlog.walFiles[part].WriteAll()
+
+			// WriteConcurrentBatch lets this partition's own records
+			// share a single group commit, on top of letting other
+			// goroutines' writeBatch calls to the same partition share
+			// its fsync too - which the old PendingWrites + WriteAll +
+			// a manual vlog.sync() afterwards couldn't do.
+			bufs := make([][]byte, len(partitionRecords[part]))
+			for j, record := range partitionRecords[part] {
+				bufs[j] = encodeValueLogRecord(record)
+			}
+			positions, err := vlog.walFiles[part].WriteConcurrentBatch(bufs)
 			if err != nil {
 				return err
 			}
-			for i, pos := range positions {
-				keyPositions = append(keyPositions, &KeyPosition{
-					key:       partitionRecords[part][writeIdx+i].key,
+
+			keyPositions := make([]*KeyPosition, len(positions))
+			for j, pos := range positions {
+				keyPositions[j] = &KeyPosition{
+					key:       partitionRecords[part][j].key,
 					partition: uint32(part),
 					position:  pos,
-				})
+				}
 			}
 			posChan <- keyPositions
 			return nil
@@ -0,0 +1,371 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkpointDirPrefix names the on-disk subdirectories Checkpoint creates
+// under Options.DirPath, following Prometheus TSDB's wal/checkpoint.NNNNNN
+// convention. A directory still carrying the ".tmp" suffix is one that
+// was interrupted mid-write, and is discarded the next time Open runs.
+const checkpointDirPrefix = "checkpoint."
+
+// checkpointDirName returns the directory name for the checkpoint whose
+// watermark is upto, e.g. "checkpoint.000000042".
+func checkpointDirName(upto SegmentID) string {
+	return fmt.Sprintf("%s%09d", checkpointDirPrefix, upto)
+}
+
+// parseCheckpointID extracts the watermark from a checkpoint directory
+// name, or reports ok=false if name isn't a complete checkpoint directory.
+func parseCheckpointID(name string) (upto SegmentID, ok bool) {
+	if !strings.HasPrefix(name, checkpointDirPrefix) || strings.HasSuffix(name, ".tmp") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(name, checkpointDirPrefix), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return SegmentID(n), true
+}
+
+// segmentIDsIn returns the numeric ids of every segment file with the
+// given extension directly inside dir.
+func segmentIDsIn(dir, extName string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id int
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+extName, &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadCheckpoint discards any interrupted (*.tmp) checkpoint directory,
+// keeps only the highest complete checkpoint.NNN - an earlier one is
+// always a strict subset of a later one, since every checkpoint covers
+// everything from the start of the WAL - and opens its segment files into
+// wal.checkpointSegments. Open calls this before looking at the regular
+// segment files.
+func (wal *WAL) loadCheckpoint() error {
+	entries, err := os.ReadDir(wal.options.DirPath)
+	if err != nil {
+		return err
+	}
+
+	var (
+		bestUpto SegmentID
+		bestName string
+		found    bool
+	)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), checkpointDirPrefix) && strings.HasSuffix(entry.Name(), ".tmp") {
+			if err := os.RemoveAll(filepath.Join(wal.options.DirPath, entry.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		upto, ok := parseCheckpointID(entry.Name())
+		if !ok {
+			continue
+		}
+		if found && upto <= bestUpto {
+			if err := os.RemoveAll(filepath.Join(wal.options.DirPath, entry.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if found {
+			if err := os.RemoveAll(filepath.Join(wal.options.DirPath, bestName)); err != nil {
+				return err
+			}
+		}
+		bestUpto, bestName, found = upto, entry.Name(), true
+	}
+
+	if !found {
+		return nil
+	}
+
+	checkpointDir := filepath.Join(wal.options.DirPath, bestName)
+	segmentIDs, err := segmentIDsIn(checkpointDir, wal.options.SegmentFileExt)
+	if err != nil {
+		return err
+	}
+	sort.Ints(segmentIDs)
+	for _, id := range segmentIDs {
+		// checkpoint segments are always fully synced before the directory
+		// holding them is renamed into place (see Checkpoint), so there is
+		// nothing to repair here.
+		seg, err := openSegmentFile(checkpointDir, wal.options.SegmentFileExt,
+			uint32(id), wal.options.SegmentSize, wal.cipherID(), wal.options.MMapRead, false)
+		if err != nil {
+			return err
+		}
+		wal.checkpointSegments = append(wal.checkpointSegments, seg)
+	}
+
+	wal.checkpointDir = checkpointDir
+	wal.checkpointUpto = bestUpto
+	wal.hasCheckpoint = true
+	return nil
+}
+
+// CheckpointFilter decides, for every record up to a Checkpoint's
+// watermark, whether it survives into the checkpoint and, if so, lets the
+// caller rewrite its payload before it is re-sealed. data is the fully
+// decrypted and decompressed record, exactly as WAL.Read would return it.
+type CheckpointFilter func(data []byte, pos *ChunkPosition) (keep bool, newData []byte, err error)
+
+// PositionRemap records where a record kept by a CheckpointFilter ended
+// up: Old is the ChunkPosition it was read from, New is where it was
+// rewritten to in the checkpoint's own segment files. Checkpoint returns
+// one of these per kept record, since rewriting a record into a fresh
+// segment sequence otherwise strands any position a caller had indexed
+// it under - e.g. lotusdb's valueLog needs these to update its key index
+// after checkpointing its value log.
+type PositionRemap struct {
+	Old *ChunkPosition
+	New *ChunkPosition
+}
+
+// Checkpoint rewrites every record stored up to and including the segment
+// watermark upto through filter, the same shape as Prometheus TSDB's WAL
+// checkpointing: records filter keeps (optionally rewritten by it) are
+// re-sealed into a fresh sequence of segment files written to
+// checkpoint.<upto>.tmp under Options.DirPath. Once that directory is
+// fsynced, it is atomically renamed to checkpoint.<upto>, and the segments
+// (and any earlier checkpoint) it supersedes are retired via Truncate.
+//
+// upto must be strictly less than the active segment's id, since the
+// active segment is still being written to. A Checkpoint interrupted
+// before the rename leaves only a .tmp directory behind, which Open
+// discards on the next startup, so from a reader's perspective a
+// checkpoint either completes in full or never happened.
+//
+// This gives callers like lotusdb's valueLog a real garbage-collection
+// primitive: filter can drop records whose keys have since been
+// overwritten or deleted, instead of relying on an external merge to
+// rewrite the whole value log.
+func (wal *WAL) Checkpoint(upto SegmentID, filter CheckpointFilter) ([]PositionRemap, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if upto >= wal.activeSegment.id {
+		return nil, fmt.Errorf("wal: checkpoint watermark %d must be below the active segment %d", upto, wal.activeSegment.id)
+	}
+	if wal.hasCheckpoint && upto <= wal.checkpointUpto {
+		return nil, fmt.Errorf("wal: checkpoint watermark %d must be above the current checkpoint %d", upto, wal.checkpointUpto)
+	}
+
+	// scan everything the checkpoint must cover: whatever an earlier
+	// checkpoint already holds, plus the original segments between that
+	// watermark (exclusive) and the new one.
+	var segments []*segment
+	for _, seg := range wal.olderSegments {
+		if seg.id <= upto {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+	segments = append(append([]*segment{}, wal.checkpointSegments...), segments...)
+
+	dirName := checkpointDirName(upto)
+	tmpDir := filepath.Join(wal.options.DirPath, dirName+".tmp")
+	finalDir := filepath.Join(wal.options.DirPath, dirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	ckSeg, err := openSegmentFile(tmpDir, wal.options.SegmentFileExt,
+		initialSegmentFileID, wal.options.SegmentSize, wal.cipherID(), false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaps []PositionRemap
+	for _, seg := range segments {
+		reader := seg.NewReader()
+		for {
+			blob, compressed, _, pos, rerr := reader.Next()
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return nil, rerr
+			}
+			nonceRecord, ciphertext, derr := decodeCompoundPayload(blob)
+			if derr != nil {
+				return nil, derr
+			}
+
+			plaintext, oerr := wal.open(ciphertext, nonceRecord, seg.cipherID)
+			if oerr != nil {
+				return nil, oerr
+			}
+			plaintext, oerr = decompress(plaintext, compressed)
+			if oerr != nil {
+				return nil, oerr
+			}
+
+			keep, newData, ferr := filter(plaintext, pos)
+			if ferr != nil {
+				return nil, ferr
+			}
+			if !keep {
+				continue
+			}
+			if newData != nil {
+				plaintext = newData
+			}
+
+			compressedData, isCompressed := wal.compress(plaintext)
+			payload, newNonceRecord, serr := wal.seal(compressedData)
+			if serr != nil {
+				return nil, serr
+			}
+			newBlob := encodeCompoundPayload(newNonceRecord, payload)
+			if ckSeg.Size()+wal.maxDataWriteSize(int64(len(newBlob))) > wal.options.SegmentSize {
+				if err := ckSeg.Sync(); err != nil {
+					return nil, err
+				}
+				if err := ckSeg.Close(); err != nil {
+					return nil, err
+				}
+				ckSeg, err = openSegmentFile(tmpDir, wal.options.SegmentFileExt,
+					ckSeg.id+1, wal.options.SegmentSize, wal.cipherID(), false, false)
+				if err != nil {
+					return nil, err
+				}
+			}
+			newPos, werr := ckSeg.Write(newBlob, isCompressed, RecordTypeData)
+			if werr != nil {
+				return nil, werr
+			}
+			remaps = append(remaps, PositionRemap{Old: pos, New: newPos})
+		}
+	}
+
+	if err := ckSeg.Sync(); err != nil {
+		return nil, err
+	}
+	if err := ckSeg.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(finalDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, finalDir); err != nil {
+		return nil, err
+	}
+
+	oldCheckpointDir := wal.checkpointDir
+	if err := wal.retireCheckpointSegments(); err != nil {
+		return nil, err
+	}
+	if err := wal.truncateLocked(upto); err != nil {
+		return nil, err
+	}
+	if oldCheckpointDir != "" {
+		if err := os.RemoveAll(oldCheckpointDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wal.adoptCheckpoint(finalDir, upto); err != nil {
+		return nil, err
+	}
+	return remaps, nil
+}
+
+// retireCheckpointSegments closes (without deleting - the files already
+// moved into the superseded checkpoint directory, which the caller
+// removes separately) every segment currently in wal.checkpointSegments.
+func (wal *WAL) retireCheckpointSegments() error {
+	for _, seg := range wal.checkpointSegments {
+		if err := seg.Close(); err != nil {
+			return err
+		}
+	}
+	wal.checkpointSegments = nil
+	return nil
+}
+
+// adoptCheckpoint opens the segment files freshly written to dir (by
+// Checkpoint) and installs them as wal.checkpointSegments.
+func (wal *WAL) adoptCheckpoint(dir string, upto SegmentID) error {
+	segmentIDs, err := segmentIDsIn(dir, wal.options.SegmentFileExt)
+	if err != nil {
+		return err
+	}
+	sort.Ints(segmentIDs)
+	segments := make([]*segment, 0, len(segmentIDs))
+	for _, id := range segmentIDs {
+		// the checkpoint this directory belongs to has just been fsynced
+		// and atomically renamed into place by Checkpoint, so its segments
+		// can't be torn; nothing to repair here either.
+		seg, err := openSegmentFile(dir, wal.options.SegmentFileExt,
+			uint32(id), wal.options.SegmentSize, wal.cipherID(), wal.options.MMapRead, false)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, seg)
+	}
+	wal.checkpointSegments = segments
+	wal.checkpointDir = dir
+	wal.checkpointUpto = upto
+	wal.hasCheckpoint = true
+	return nil
+}
+
+// truncateLocked removes every tracked original segment with id <= upto
+// from the WAL, closing and deleting its file. Assumes wal.mu is already
+// held.
+func (wal *WAL) truncateLocked(upto SegmentID) error {
+	for id, seg := range wal.olderSegments {
+		if id > upto {
+			continue
+		}
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+		delete(wal.olderSegments, id)
+	}
+	return nil
+}
+
+// Truncate drops every tracked original segment with id <= upto, deleting
+// its file. It is meant to be called with the watermark of the last
+// completed Checkpoint, to retire the segments that checkpoint
+// superseded. Checkpoint already does this itself, and Open removes any
+// such segments left on disk by a crash between Checkpoint's atomic
+// rename and that step, so Truncate is only needed to retire segments
+// explicitly.
+func (wal *WAL) Truncate(upto SegmentID) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.truncateLocked(upto)
+}
@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestCheckpointReadByOriginalPosition writes a record, rotates into a new
+// segment, checkpoints with a filter that keeps everything, then Reads
+// both the *original* ChunkPosition and the remapped one. Checkpoint
+// rewrites kept records into a fresh segment id sequence under
+// wal.checkpointSegments and retires the regular segments they came from,
+// and Read falls back to a checkpoint segment with the same id once the
+// regular one is gone. Here the single kept record is rewritten to
+// checkpoint segment 1, block 0, offset 0 - the same coordinates it had
+// originally - so the original position still resolves to it; in general
+// only the remapped position is guaranteed to.
+func TestCheckpointReadByOriginalPosition(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{
+		DirPath:        dir,
+		SegmentSize:    blockSize * 4,
+		SegmentFileExt: ".SEG",
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer wal.Close()
+
+	data := []byte("keep me across the checkpoint")
+	pos, err := wal.Write(data)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := wal.OpenNewActiveSegment(); err != nil {
+		t.Fatalf("OpenNewActiveSegment: %v", err)
+	}
+
+	upto := wal.ActiveSegmentID() - 1
+	keepAll := func(data []byte, pos *ChunkPosition) (bool, []byte, error) {
+		return true, nil, nil
+	}
+	remaps, err := wal.Checkpoint(upto, keepAll)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if len(remaps) != 1 {
+		t.Fatalf("got %d remaps, want 1", len(remaps))
+	}
+	if remaps[0].Old.SegmentId != pos.SegmentId || remaps[0].Old.BlockNumber != pos.BlockNumber {
+		t.Fatalf("remap.Old %+v does not match the original position %+v", remaps[0].Old, pos)
+	}
+
+	got, err := wal.Read(pos)
+	if err != nil {
+		t.Fatalf("Read(original position) after checkpoint: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Read(original position) = %q, want %q", got, data)
+	}
+
+	gotNew, err := wal.Read(remaps[0].New)
+	if err != nil {
+		t.Fatalf("Read(remapped position): %v", err)
+	}
+	if !bytes.Equal(gotNew, data) {
+		t.Fatalf("Read(remapped position) = %q, want %q", gotNew, data)
+	}
+}
+
+// TestCheckpointDropsFilteredRecords checks the other half of the filter
+// contract: a record the filter declines to keep must not survive the
+// checkpoint, and must not appear in the returned remaps.
+func TestCheckpointDropsFilteredRecords(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{
+		DirPath:        dir,
+		SegmentSize:    blockSize * 4,
+		SegmentFileExt: ".SEG",
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer wal.Close()
+
+	dropped := []byte("drop me")
+	kept := []byte("keep me")
+	if _, err := wal.Write(dropped); err != nil {
+		t.Fatalf("Write(dropped): %v", err)
+	}
+	if _, err := wal.Write(kept); err != nil {
+		t.Fatalf("Write(kept): %v", err)
+	}
+
+	if err := wal.OpenNewActiveSegment(); err != nil {
+		t.Fatalf("OpenNewActiveSegment: %v", err)
+	}
+
+	upto := wal.ActiveSegmentID() - 1
+	filter := func(data []byte, pos *ChunkPosition) (bool, []byte, error) {
+		return !bytes.Equal(data, dropped), nil, nil
+	}
+	remaps, err := wal.Checkpoint(upto, filter)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if len(remaps) != 1 {
+		t.Fatalf("got %d remaps, want 1 (the dropped record must not appear)", len(remaps))
+	}
+
+	got, err := wal.Read(remaps[0].New)
+	if err != nil {
+		t.Fatalf("Read(remapped kept position): %v", err)
+	}
+	if !bytes.Equal(got, kept) {
+		t.Fatalf("Read(remapped kept position) = %q, want %q", got, kept)
+	}
+}
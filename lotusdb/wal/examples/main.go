@@ -11,16 +11,16 @@ import (
 func main() {
 	walFile, _ := wal.Open(wal.DefaultOptions)
 	// write some data
-	chunkPosition, _ := walFile.Write([]byte("some data 1"), nil)
+	chunkPosition, _ := walFile.Write([]byte("some data 1"))
 	// read by the position
-	val, _, _ := walFile.Read(chunkPosition)
+	val, _ := walFile.Read(chunkPosition)
 	fmt.Println(string(val))
 
-	_, err := walFile.Write([]byte("some data 2"), nil)
+	_, err := walFile.Write([]byte("some data 2"))
 	if err != nil {
 		log.Println(err)
 	}
-	_, err = walFile.Write([]byte("some data 3"), nil)
+	_, err = walFile.Write([]byte("some data 3"))
 	if err != nil {
 		log.Println(err)
 	}
@@ -28,7 +28,7 @@ func main() {
 	// iterate all data in wal
 	reader := walFile.NewReader()
 	for {
-		val, _, pos, err := reader.Next()
+		val, pos, err := reader.Next()
 		if err == io.EOF {
 			break
 		}
@@ -0,0 +1,10 @@
+package wal
+
+// Logger receives warnings the WAL has no other way to surface, such as a
+// slow fsync (see Options.SyncWarnDuration). Implementations must be safe
+// for concurrent use, since they may be called from the background
+// group-commit goroutine while the caller's own goroutines are still
+// running. The standard library's *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// legacyChunkHeaderSize is the on-disk chunk header width used by segments
+// written before compound nonce+payload framing: Checksum(4) Length(2)
+// Type(1), with no RecordType byte. MigrateNonceSidecar is the only thing
+// in this package that ever reads this layout; everything else only
+// understands the current chunkHeaderSize (8).
+const legacyChunkHeaderSize = 7
+
+// legacyRecordReader sequentially reassembles whole logical records out of
+// a segment file written with legacyChunkHeaderSize framing, the same way
+// segmentReader.Next does for the current format.
+type legacyRecordReader struct {
+	fd          *os.File
+	blockNumber uint32
+	chunkOffset int64
+}
+
+// next reads and reassembles the next whole record, returning its raw
+// bytes (still sealed/compressed exactly as they were on disk) and
+// whether it was stored compressed. It returns io.EOF once it reaches
+// unwritten, preallocated space.
+func (r *legacyRecordReader) next() (data []byte, compressed bool, err error) {
+	for {
+		if r.chunkOffset+legacyChunkHeaderSize >= blockSize {
+			r.blockNumber++
+			r.chunkOffset = 0
+			continue
+		}
+
+		offset := int64(segmentHeaderSize) + int64(r.blockNumber)*blockSize + r.chunkOffset
+		header := make([]byte, legacyChunkHeaderSize)
+		n, rerr := r.fd.ReadAt(header, offset)
+		if rerr != nil && rerr != io.EOF {
+			return nil, false, rerr
+		}
+		if n < legacyChunkHeaderSize || isZeroHeader(header[:n]) {
+			return nil, false, io.EOF
+		}
+
+		length := binary.LittleEndian.Uint16(header[4:6])
+		chunkType := header[6]
+
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, rerr := r.fd.ReadAt(payload, offset+legacyChunkHeaderSize); rerr != nil {
+				return nil, false, rerr
+			}
+		}
+
+		base := baseChunkType(chunkType)
+		if base == ChunkTypePadding {
+			// a padding chunk always fills out the rest of its block (see
+			// appendRecordChunks), so the next record starts at the
+			// following block regardless of this chunk's own length.
+			r.blockNumber++
+			r.chunkOffset = 0
+			continue
+		}
+
+		r.chunkOffset += int64(legacyChunkHeaderSize) + int64(length)
+		if r.chunkOffset >= blockSize {
+			r.blockNumber += uint32(r.chunkOffset / blockSize)
+			r.chunkOffset %= blockSize
+		}
+
+		isCompressed := chunkType&chunkCompressedFlag != 0
+		switch base {
+		case ChunkTypeFull:
+			return payload, isCompressed, nil
+		case ChunkTypeFirst:
+			data = append(data[:0], payload...)
+			compressed = isCompressed
+		case ChunkTypeMiddle:
+			data = append(data, payload...)
+		case ChunkTypeLast:
+			data = append(data, payload...)
+			return data, compressed, nil
+		}
+	}
+}
+
+// legacyNonceReader sequentially reads fixed-width nonce records off the
+// old sidecar file nonceFile used to write, in the same ValueNum order
+// they were originally appended in.
+type legacyNonceReader struct {
+	fd   *os.File
+	next int64
+}
+
+// read returns the next nonce record, or (nil, false, nil) once the
+// sidecar is exhausted - which is the normal case for every record
+// migrated from a WAL that never had a Cipher configured, since
+// nonceFile.Write never wrote anything for a nil record.
+func (r *legacyNonceReader) read() (record []byte, ok bool, err error) {
+	buf := make([]byte, nonceRecordSize)
+	n, rerr := r.fd.ReadAt(buf, r.next*nonceRecordSize)
+	if n < nonceRecordSize {
+		if rerr != nil && rerr != io.EOF {
+			return nil, false, rerr
+		}
+		return nil, false, nil
+	}
+	r.next++
+	return buf, true, nil
+}
+
+// MigrateNonceSidecar is a one-shot migration for a WAL directory written
+// before compound nonce+payload framing. It reads every record out of the
+// legacy segment files in oldDir, pairs each one (in order) with its
+// record from the old nonce sidecar file in oldNonceDir, and rewrites them
+// as compound records (see encodeCompoundPayload) into a fresh WAL rooted
+// at newDir, so a value and its nonce can never again desynchronize on
+// crash the way the separate sidecar file could.
+//
+// oldDir and oldNonceDir are read directly, without going through Open,
+// since Open's segment header validation now rejects anything but the
+// current chunkHeaderSize (8) layout. newDir is created with DefaultOptions
+// (aside from DirPath) and must not already contain a WAL; callers that
+// need a non-default SegmentSize, Cipher, or Compression for the migrated
+// WAL should reopen newDir with those options afterwards - MigrateNonceSidecar
+// only ever carries bytes over as-is, it never re-seals or re-compresses
+// them.
+func MigrateNonceSidecar(oldDir, oldNonceDir, newDir string) error {
+	ext := DefaultOptions.SegmentFileExt
+
+	segmentIDs, err := segmentIDsIn(oldDir, ext)
+	if err != nil {
+		return err
+	}
+	sort.Ints(segmentIDs)
+
+	nonceReader := &legacyNonceReader{}
+	nonceFd, err := os.Open(filepath.Join(oldNonceDir, "nonce"+ext))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		defer nonceFd.Close()
+		nonceReader.fd = nonceFd
+	}
+
+	newWAL, err := Open(Options{
+		DirPath:        newDir,
+		SegmentSize:    DefaultOptions.SegmentSize,
+		SegmentFileExt: ext,
+		Sync:           DefaultOptions.Sync,
+		BytesPerSync:   DefaultOptions.BytesPerSync,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range segmentIDs {
+		if err := migrateSegment(oldDir, ext, uint32(id), nonceReader, newWAL); err != nil {
+			_ = newWAL.Close()
+			return fmt.Errorf("wal: migrate segment %d%s failed: %w", id, ext, err)
+		}
+	}
+
+	if err := newWAL.Sync(); err != nil {
+		_ = newWAL.Close()
+		return err
+	}
+	return newWAL.Close()
+}
+
+// migrateSegment migrates every record in one legacy segment file.
+func migrateSegment(oldDir, ext string, id uint32, nonceReader *legacyNonceReader, newWAL *WAL) error {
+	fd, err := os.Open(SegmentFileName(oldDir, ext, id))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	reader := &legacyRecordReader{fd: fd}
+	for {
+		payload, compressed, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var nonceRecord []byte
+		if nonceReader.fd != nil {
+			nonceRecord, _, err = nonceReader.read()
+			if err != nil {
+				return err
+			}
+		}
+
+		compound := encodeCompoundPayload(nonceRecord, payload)
+		if _, err := newWAL.rawWrite(compound, compressed); err != nil {
+			return err
+		}
+	}
+}
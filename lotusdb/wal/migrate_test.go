@@ -0,0 +1,141 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLegacySegment writes a minimal legacy-format segment file (the
+// layout MigrateNonceSidecar reads: segmentHeaderSize of leading bytes,
+// then Checksum(4, unchecked by legacyRecordReader) Length(2) Type(1)
+// headers each immediately followed by their payload, every record a
+// single ChunkTypeFull chunk) containing records.
+func writeLegacySegment(t *testing.T, dir, ext string, id uint32, records [][]byte) {
+	t.Helper()
+	fd, err := os.OpenFile(SegmentFileName(dir, ext, id), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("create legacy segment: %v", err)
+	}
+	defer fd.Close()
+
+	buf := make([]byte, segmentHeaderSize)
+	if _, err := fd.Write(buf); err != nil {
+		t.Fatalf("write legacy segment header: %v", err)
+	}
+	for _, rec := range records {
+		header := make([]byte, legacyChunkHeaderSize)
+		binary.LittleEndian.PutUint16(header[4:6], uint16(len(rec)))
+		header[6] = ChunkTypeFull
+		if _, err := fd.Write(header); err != nil {
+			t.Fatalf("write legacy chunk header: %v", err)
+		}
+		if _, err := fd.Write(rec); err != nil {
+			t.Fatalf("write legacy chunk payload: %v", err)
+		}
+	}
+}
+
+// TestMigrateNonceSidecarWithoutNonceFile covers the common case: a
+// legacy WAL that never had a Cipher configured, so nonceFile.Write never
+// wrote anything and there is no sidecar to read.
+func TestMigrateNonceSidecarWithoutNonceFile(t *testing.T) {
+	oldDir := t.TempDir()
+	oldNonceDir := t.TempDir()
+	newDir := t.TempDir()
+	ext := DefaultOptions.SegmentFileExt
+
+	records := [][]byte{[]byte("legacy record one"), []byte("legacy record two")}
+	writeLegacySegment(t, oldDir, ext, 1, records)
+
+	if err := MigrateNonceSidecar(oldDir, oldNonceDir, newDir); err != nil {
+		t.Fatalf("MigrateNonceSidecar: %v", err)
+	}
+
+	newWAL, err := Open(Options{
+		DirPath:        newDir,
+		SegmentSize:    DefaultOptions.SegmentSize,
+		SegmentFileExt: ext,
+	})
+	if err != nil {
+		t.Fatalf("Open migrated WAL: %v", err)
+	}
+	defer newWAL.Close()
+
+	reader := newWAL.NewReader()
+	for i, want := range records {
+		got, _, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Next(%d): %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Next(%d) = %q, want %q", i, got, want)
+		}
+	}
+	if _, _, err := reader.Next(); err == nil {
+		t.Fatalf("expected io.EOF after the last migrated record")
+	}
+}
+
+// TestMigrateNonceSidecarWithNonceFile covers a legacy WAL that did have
+// a Cipher configured: each record's nonce record, read off the old
+// sidecar file in ValueNum order, must end up paired with the right
+// record in the new compound framing.
+func TestMigrateNonceSidecarWithNonceFile(t *testing.T) {
+	oldDir := t.TempDir()
+	oldNonceDir := t.TempDir()
+	newDir := t.TempDir()
+	ext := DefaultOptions.SegmentFileExt
+
+	records := [][]byte{[]byte("ciphertext-one"), []byte("ciphertext-two")}
+	writeLegacySegment(t, oldDir, ext, 1, records)
+
+	nonces := [][]byte{
+		encodeNonceRecord(1, bytes.Repeat([]byte{0x01}, nonceSize)),
+		encodeNonceRecord(1, bytes.Repeat([]byte{0x02}, nonceSize)),
+	}
+	nonceFd, err := os.OpenFile(filepath.Join(oldNonceDir, "nonce"+ext), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("create legacy nonce sidecar: %v", err)
+	}
+	for _, n := range nonces {
+		if _, err := nonceFd.Write(n); err != nil {
+			t.Fatalf("write legacy nonce record: %v", err)
+		}
+	}
+	nonceFd.Close()
+
+	if err := MigrateNonceSidecar(oldDir, oldNonceDir, newDir); err != nil {
+		t.Fatalf("MigrateNonceSidecar: %v", err)
+	}
+
+	newWAL, err := Open(Options{
+		DirPath:        newDir,
+		SegmentSize:    DefaultOptions.SegmentSize,
+		SegmentFileExt: ext,
+	})
+	if err != nil {
+		t.Fatalf("Open migrated WAL: %v", err)
+	}
+	defer newWAL.Close()
+
+	segReader := newWAL.activeSegment.NewReader()
+	for i, want := range records {
+		blob, _, _, _, err := segReader.Next()
+		if err != nil {
+			t.Fatalf("Next(%d): %v", i, err)
+		}
+		nonceRecord, payload, err := decodeCompoundPayload(blob)
+		if err != nil {
+			t.Fatalf("decodeCompoundPayload(%d): %v", i, err)
+		}
+		if !bytes.Equal(payload, want) {
+			t.Fatalf("payload(%d) = %q, want %q", i, payload, want)
+		}
+		if !bytes.Equal(nonceRecord, nonces[i]) {
+			t.Fatalf("nonceRecord(%d) = %x, want %x (sidecar record desynchronized from its payload)", i, nonceRecord, nonces[i])
+		}
+	}
+}
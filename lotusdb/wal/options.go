@@ -1,15 +1,15 @@
 package wal
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 // Options represents the configuration options for a Write-Ahead Log (WAL).
 type Options struct {
 	// DirPath specifies the directory path where the WAL segment files will be stored.
 	DirPath string
 
-	// NonceDirPath specifies the directory path where the nonce file will be stored.
-	NonceDirPath string
-
 	// SegmentSize specifies the maximum size of each segment file in bytes.
 	SegmentSize int64
 
@@ -32,6 +32,70 @@ type Options struct {
 
 	// BytesPerSync specifies the number of bytes to write before calling fsync.
 	BytesPerSync uint32
+
+	// MMapRead, when true, memory-maps closed segment files read-only and
+	// has Read/Reader.Next take each block as a slice of the mapped region
+	// instead of ReadAt into a blockPool buffer; the chunk payloads are
+	// still copied out of it into the returned value. The active segment is
+	// still being written to via explicit offsets, so it stays on a
+	// normal *os.File; it's only promoted into the mmap pool once
+	// rotation (or OpenNewActiveSegment) retires it. It falls back to
+	// the ReadAt path automatically wherever mmap isn't available (e.g.
+	// unsupported platform), so it is always safe to set.
+	MMapRead bool
+
+	// Cipher, when set, transparently encrypts every value written to the
+	// WAL and decrypts it again on Read. The nonce each Seal call produces
+	// is recorded alongside a KeyID in the same compound record as the
+	// value, so a Cipher backed by a rotating KeyProvider can keep reading
+	// records sealed under older keys after rotation. Leave nil to store
+	// values as plaintext.
+	Cipher Cipher
+
+	// Compression selects the algorithm used to compress values before
+	// they are written to the WAL. Compression is applied before Cipher
+	// seals the record, and is skipped on a per-value basis whenever it
+	// wouldn't actually shrink the payload. Leave at CompressionNone (the
+	// zero value) to store values uncompressed.
+	Compression CompressionType
+
+	// RepairOnOpen, when true, makes Open tolerate a torn tail chunk or a
+	// checksum mismatch left behind by a crash mid-write: instead of
+	// failing, the affected segment is truncated back to its last
+	// known-good chunk boundary and resumes accepting writes from there.
+	// Leave false to have Open fail loudly on such corruption instead, and
+	// use WAL.Verify/WAL.Repair to diagnose and fix it explicitly.
+	RepairOnOpen bool
+
+	// GroupCommitInterval, when nonzero, makes Write join WriteConcurrent
+	// on the background group-commit goroutine instead of syncing solo,
+	// and bounds how long that goroutine waits to collect more concurrent
+	// writers before it commits: it commits as soon as
+	// MaxGroupCommitBatch requests have arrived, or this interval has
+	// elapsed since the first one, whichever comes first. Leave this and
+	// MaxGroupCommitBatch both at zero (the default) to keep Write's
+	// direct, synchronous-per-call behavior and WriteConcurrent's existing
+	// opportunistic batching, which only coalesces whatever already
+	// happens to be queued instead of waiting for more.
+	GroupCommitInterval time.Duration
+
+	// MaxGroupCommitBatch caps how many requests the group-commit
+	// goroutine collects into one commit, whether it waits for them
+	// (GroupCommitInterval set) or only takes what is already queued.
+	// Setting it also makes Write join WriteConcurrent on the group-commit
+	// goroutine, as GroupCommitInterval does. Leave at zero to leave a
+	// batch's size uncapped.
+	MaxGroupCommitBatch int
+
+	// SyncWarnDuration, when nonzero, makes the group-commit goroutine
+	// warn through Logger whenever a single Sync call takes longer than
+	// this to complete. Requires Logger to be set; has no effect
+	// otherwise.
+	SyncWarnDuration time.Duration
+
+	// Logger receives warnings the WAL has no other way to surface, such
+	// as a slow fsync (see SyncWarnDuration). Leave nil to disable them.
+	Logger Logger
 }
 
 const (
@@ -41,9 +105,21 @@ const (
 	GB = 1024 * MB
 )
 
+// CompressionType identifies the compression algorithm applied to a
+// value before it is written to the WAL.
+type CompressionType = byte
+
+const (
+	// CompressionNone stores values uncompressed.
+	CompressionNone CompressionType = 0
+	// CompressionSnappy compresses values with Snappy, the same
+	// self-framed block format InfluxDB's TSM and Prometheus's TSDB use
+	// for their own WAL/chunk compression.
+	CompressionSnappy CompressionType = 1
+)
+
 var DefaultOptions = Options{
 	DirPath:        os.TempDir(),
-	NonceDirPath:   os.TempDir(),
 	SegmentSize:    GB,
 	SegmentFileExt: ".SEG",
 	Sync:           false,
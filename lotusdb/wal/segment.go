@@ -20,18 +20,63 @@ const (
 	ChunkTypeFirst
 	ChunkTypeMiddle
 	ChunkTypeLast
+	// ChunkTypePadding marks a chunk written purely to fill out the tail
+	// of a block, so a header never straddles a block boundary. Readers
+	// never need to recognize it explicitly: position bookkeeping always
+	// jumps straight past it to the start of the next block, the same
+	// way it already does for the shorter raw-zero-fill case below.
+	ChunkTypePadding
+)
+
+// chunkCompressedFlag is ORed into a chunk header's type byte to record
+// that the record it belongs to was compressed before being chunked.
+// ChunkType itself only ever needs its low 3 bits, leaving this bit free.
+const chunkCompressedFlag ChunkType = 0x80
+
+// baseChunkType strips chunkCompressedFlag, returning the underlying
+// ChunkTypeFull/First/Middle/Last value.
+func baseChunkType(b byte) ChunkType {
+	return b &^ chunkCompressedFlag
+}
+
+// RecordType is stamped into every physical chunk's header (the same way
+// etcd multiplexes metadataType/entryType/crcType/snapshotType chunks
+// through its own WAL, and Prometheus TSDB multiplexes WALEntrySymbols/
+// WALEntrySeries/... records), so more than one kind of entry can share
+// the same log without ambiguity about how to interpret a given record.
+type RecordType = byte
+
+const (
+	// RecordTypeData is an ordinary value written through WAL.Write/
+	// WriteAll/WriteConcurrent: a compound nonce+payload blob, see
+	// encodeCompoundPayload.
+	RecordTypeData RecordType = iota
+	// RecordTypeTombstone is reserved for a future subsystem built on top
+	// of the WAL to mark a deleted key; nothing in this package writes it
+	// yet.
+	RecordTypeTombstone
+	// RecordTypeCheckpointMarker is reserved for a future subsystem to
+	// mark a checkpoint boundary inline in the log; nothing in this
+	// package writes it yet.
+	RecordTypeCheckpointMarker
 )
 
 var (
-	ErrClosed     = errors.New("the segment file is closed")
-	ErrInvalidCRC = errors.New("invalid crc, the data may be corrupted")
+	ErrClosed              = errors.New("the segment file is closed")
+	ErrInvalidCRC          = errors.New("invalid crc, the data may be corrupted")
+	ErrInvalidSegmentHeader = errors.New("wal: invalid or incompatible segment file header")
 )
 
+// crc32cTable is the Castagnoli polynomial table used to checksum every
+// chunk header+payload, the same variant etcd's WAL and Prometheus TSDB
+// checksum their own records with.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 const (
-	// 7 Bytes
-	// Checksum Length Type
-	//    4      2     1
-	chunkHeaderSize = 7
+	// 8 Bytes
+	// Checksum Length Type RecordType
+	//    4      2     1       1
+	chunkHeaderSize = 8
 
 	// 32 KB
 	blockSize = 32 * KB
@@ -44,13 +89,25 @@ const (
 
 	// 12-byte nonce for AES-256
 	nonceSize = 12
-)
 
-type nonceFile struct {
-	fd     *os.File
-	curNum int64
-	closed bool
-}
+	// segmentMagic identifies a twinstore wal segment file, the same way
+	// Prometheus TSDB chunk files start with their own magic number.
+	segmentMagic uint32 = 0x85BD40DD
+
+	// segmentFormatV1 is the only segment format version understood so
+	// far; bumping it lets future, incompatible layout changes refuse to
+	// open old segments instead of silently misreading them.
+	segmentFormatV1 byte = 1
+
+	// segmentHeaderSize is the fixed-size header written at the start of
+	// every segment file: magic(4) + version(1) + blockSize(4) +
+	// chunkHeaderSize(1) + cipherID(1), padded out to a round number so
+	// later fields can be added without another layout bump.
+	//
+	// Magic Version BlockSize ChunkHeaderSize CipherID Reserved
+	//   4      1         4           1            1        5
+	segmentHeaderSize = 16
+)
 
 // Segment represents a single segment file in WAL.
 // The segment file is append-only, and the data is written in blocks.
@@ -64,6 +121,16 @@ type segment struct {
 	header             []byte
 	startupBlock       *startupBlock
 	isStartupTraversal bool
+	// cipherID is the CipherID this segment's header was written with, so
+	// a directory can mix segments sealed under different Cipher
+	// implementations (e.g. across a migration) without ambiguity.
+	cipherID byte
+	// mmapData is a read-only mapping of the segment file, used by
+	// readInternal to slice chunks directly out of the page cache instead
+	// of copying through blockPool. It is nil when Options.MMapRead is
+	// false or mmap isn't available on this platform, in which case
+	// readInternal falls back to ReadAt.
+	mmapData []byte
 }
 
 // segmentReader is used to iterate all the data from the segment file.
@@ -93,8 +160,6 @@ type ChunkPosition struct {
 	ChunkOffset int64
 	// ChunkSize How many bytes the chunk data takes up in the segment file.
 	ChunkSize uint32
-	// ValueNum What the number of the current value is.
-	ValueNum int64
 }
 
 var blockPool = sync.Pool{
@@ -111,117 +176,317 @@ func putBuffer(buf []byte) {
 	blockPool.Put(buf)
 }
 
-// openNonceFile a new nonce file.
-func openNonceFile(dirPath, extName string) (*nonceFile, error) {
-	fd, err := os.OpenFile(
-		NonceFileName(dirPath, extName),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
-		fileModePerm,
-	)
+// writeSegmentHeader writes the fixed-size header at the start of a brand
+// new segment file, following Prometheus TSDB's chunk file layout: a
+// magic number, a format version, and enough metadata about the layout
+// this file was created with (block size, chunk header size, CipherID)
+// that a mismatched reader can refuse to open it instead of misreading it.
+func writeSegmentHeader(fd *os.File, cipherID byte) error {
+	header := make([]byte, segmentHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], segmentMagic)
+	header[4] = segmentFormatV1
+	binary.LittleEndian.PutUint32(header[5:9], uint32(blockSize))
+	header[9] = chunkHeaderSize
+	header[10] = cipherID
+	_, err := fd.WriteAt(header, 0)
+	return err
+}
 
-	if err != nil {
-		return nil, err
+// readSegmentHeader validates the header of an existing segment file
+// against the layout this build of wal understands, and returns the
+// CipherID it was written with.
+func readSegmentHeader(fd *os.File) (cipherID byte, err error) {
+	header := make([]byte, segmentHeaderSize)
+	if _, err := fd.ReadAt(header, 0); err != nil {
+		return 0, err
 	}
-
-	// set the current block number and block size.
-	offset, err := fd.Seek(0, io.SeekEnd)
-	if err != nil {
-		return nil, fmt.Errorf("seek to the end of nonce file %s failed: %v", extName, err)
+	if binary.LittleEndian.Uint32(header[0:4]) != segmentMagic {
+		return 0, ErrInvalidSegmentHeader
 	}
-
-	return &nonceFile{
-		fd:     fd,
-		curNum: offset / nonceSize,
-	}, nil
-}
-
-// Write nonces to file
-func (seg *nonceFile) writeAll(nonce [][]byte, positions []*ChunkPosition) error {
-	for i := 0; i < len(nonce); i++ {
-		// write the nonce into underlying file
-		if _, err := seg.fd.Write(nonce[i]); err != nil {
-			return err
-		}
-		positions[i].ValueNum = seg.curNum
-		seg.curNum += 1
+	if header[4] != segmentFormatV1 {
+		return 0, fmt.Errorf("wal: unsupported segment format version %d", header[4])
 	}
-	return nil
+	if binary.LittleEndian.Uint32(header[5:9]) != uint32(blockSize) {
+		return 0, fmt.Errorf("wal: segment block size %d does not match the configured %d bytes",
+			binary.LittleEndian.Uint32(header[5:9]), blockSize)
+	}
+	if header[9] != chunkHeaderSize {
+		return 0, fmt.Errorf("wal: segment chunk header size %d does not match the configured %d bytes",
+			header[9], chunkHeaderSize)
+	}
+	return header[10], nil
 }
 
-// Write nonce to file.
-func (seg *nonceFile) Write(nonce []byte, position *ChunkPosition) error {
-	if len(nonce) == 0 {
-		return nil
-	}
-	// write the nonce into underlying file
-	if _, err := seg.fd.Write(nonce); err != nil {
+// setCipherID rewrites seg's on-disk header CipherID byte and updates
+// seg.cipherID to match, so a later reopen (or an open/decrypt path that
+// validates a record's segment against the configured Cipher) sees the
+// segment as sealed under cipherID rather than whatever it was written
+// with originally. Used by Rewrap once every record in the segment has
+// actually been re-sealed under the new Cipher.
+func (seg *segment) setCipherID(cipherID byte) error {
+	header := make([]byte, 1)
+	header[0] = cipherID
+	if _, err := seg.fd.WriteAt(header, 10); err != nil {
 		return err
 	}
-	position.ValueNum = seg.curNum
-	seg.curNum += 1
+	seg.cipherID = cipherID
 	return nil
 }
 
-// Sync flushes the segment file to disk.
-func (seg *nonceFile) Sync() error {
-	if seg.closed {
-		return nil
+// isZeroHeader reports whether a chunk header is all zero bytes, the
+// signature of unwritten, preallocated space.
+func isZeroHeader(header []byte) bool {
+	for _, b := range header {
+		if b != 0 {
+			return false
+		}
 	}
-	return seg.fd.Sync()
+	return true
 }
 
-// Remove removes the segment file.
-func (seg *nonceFile) Remove() error {
-	if !seg.closed {
-		seg.closed = true
-		if err := seg.fd.Close(); err != nil {
-			return err
-		}
-	}
+// CorruptionKind classifies why a chunk found by scanUsedSize or WAL.Verify
+// isn't trustworthy.
+type CorruptionKind int
 
-	return os.Remove(seg.fd.Name())
-}
+const (
+	// corruptionNone means the scan reached a clean boundary: either a
+	// zero chunk header (preallocated, unwritten space) or simply ran out
+	// of bytes to hold another header.
+	corruptionNone CorruptionKind = iota
+	// CorruptionTornWrite means a chunk header claims more payload bytes
+	// than are actually present on disk, the signature of a write that
+	// was interrupted mid-chunk by a crash.
+	CorruptionTornWrite
+	// CorruptionChecksumMismatch means a chunk's stored CRC32-Castagnoli
+	// checksum doesn't match its header+payload bytes.
+	CorruptionChecksumMismatch
+)
 
-// Close closes the segment file.
-func (seg *nonceFile) Close() error {
-	if seg.closed {
-		return nil
+// peekHasChunk reports whether block bn starts with a non-zero chunk
+// header, i.e. whether scanUsedSize should keep walking forward into that
+// block rather than conclude the log ends where it is. This matters
+// because appendRecordChunks can't always self-describe the gap it leaves
+// at a block boundary: when fewer than chunkHeaderSize bytes are left, it
+// falls back to a raw, unheadered zero-fill (there's no room for even a
+// padding chunk's header), so a zero residual at the end of one block
+// does not by itself prove there's no more real data in the next one.
+func peekHasChunk(fd *os.File, bn uint32, fileSize int64) bool {
+	offset := int64(segmentHeaderSize) + int64(bn)*blockSize
+	if offset+chunkHeaderSize > fileSize {
+		return false
+	}
+	header := make([]byte, chunkHeaderSize)
+	n, err := fd.ReadAt(header, offset)
+	if err != nil && err != io.EOF {
+		return false
 	}
+	return n == chunkHeaderSize && !isZeroHeader(header)
+}
 
-	seg.closed = true
-	return seg.fd.Close()
+// scanUsedSize finds the logical end of written data in a segment's data
+// region by walking chunk headers from the start, verifying each one's
+// checksum as it goes. This is needed because openSegmentFile preallocates
+// segments to their configured size, so the OS-reported file size no
+// longer tells us how much was actually written; it stops at the first
+// all-zero chunk header, which preallocation guarantees to find right
+// after the last real chunk (or immediately, for an empty segment), or at
+// the first chunk that fails verification, in which case kind reports why.
+//
+// A block can also end in a residual too small to hold a header at all
+// (see peekHasChunk): reaching one of those isn't by itself proof the log
+// ends there, so the scan peeks at the very next block before stopping,
+// and keeps walking forward through as many such residuals as it finds.
+func scanUsedSize(fd *os.File, fileSize int64) (blockNumber uint32, blockOffset uint32, kind CorruptionKind, err error) {
+	var bn uint32
+	for {
+		offset := int64(segmentHeaderSize) + int64(bn)*blockSize
+		if offset >= fileSize {
+			return bn, 0, corruptionNone, nil
+		}
+		readSize := int64(blockSize)
+		if offset+readSize > fileSize {
+			readSize = fileSize - offset
+		}
+		block := make([]byte, readSize)
+		n, rerr := fd.ReadAt(block, offset)
+		if rerr != nil && rerr != io.EOF {
+			return 0, 0, corruptionNone, rerr
+		}
+		block = block[:n]
+
+		var pos uint32
+		for pos+chunkHeaderSize <= uint32(len(block)) {
+			header := block[pos : pos+chunkHeaderSize]
+			if isZeroHeader(header) {
+				return bn, pos, corruptionNone, nil
+			}
+			length := binary.LittleEndian.Uint16(header[4:6])
+			payloadEnd := pos + chunkHeaderSize + uint32(length)
+			if payloadEnd > uint32(len(block)) {
+				// the header claims a payload that runs past what's on
+				// disk: a write that started but never finished.
+				return bn, pos, CorruptionTornWrite, nil
+			}
+			payload := block[pos+chunkHeaderSize : payloadEnd]
+			checksum := crc32.Checksum(header[4:], crc32cTable)
+			checksum = crc32.Update(checksum, crc32cTable, payload)
+			if binary.LittleEndian.Uint32(header[:4]) != checksum {
+				return bn, pos, CorruptionChecksumMismatch, nil
+			}
+			pos = payloadEnd
+		}
+		if pos < blockSize {
+			// what's left doesn't hold another header. If it's a small
+			// residual left by the raw zero-fill fallback, there may still
+			// be real data starting at the next block - only stop here if
+			// there isn't.
+			if peekHasChunk(fd, bn+1, fileSize) {
+				bn++
+				continue
+			}
+			return bn, pos, corruptionNone, nil
+		}
+		bn++
+	}
 }
 
-// openSegmentFile a new segment file.
-func openSegmentFile(dirPath, extName string, id uint32) (*segment, error) {
+// openSegmentFile opens or creates a segment file. New files get a fresh
+// header and are preallocated to segmentSize bytes so the filesystem
+// reserves the extent up front instead of growing it chunk-by-chunk;
+// existing files have their header validated and their logical write
+// position recovered via scanUsedSize.
+//
+// If scanUsedSize finds a torn or checksum-mismatched chunk, the segment
+// isn't trustworthy past that point: with repairOnOpen, it is truncated
+// back to the last known-good chunk boundary and the gap is reclaimed, the
+// same way etcd's WAL repairs a torn tail on startup; without it, opening
+// fails so the caller can decide what to do (e.g. surface it to an
+// operator, or call WAL.Repair explicitly).
+func openSegmentFile(dirPath, extName string, id uint32, segmentSize int64, cipherID byte, mmapRead bool, repairOnOpen bool) (*segment, error) {
 	fd, err := os.OpenFile(
 		SegmentFileName(dirPath, extName, id),
-		os.O_CREATE|os.O_RDWR|os.O_APPEND,
+		os.O_CREATE|os.O_RDWR,
 		fileModePerm,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
-	// set the current block number and block size.
-	offset, err := fd.Seek(0, io.SeekEnd)
+	info, err := fd.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("seek to the end of segment file %d%s failed: %v", id, extName, err)
+		return nil, err
 	}
 
-	return &segment{
+	var (
+		currentBlockNumber uint32
+		currentBlockSize   uint32
+		headerCipherID     = cipherID
+	)
+
+	if info.Size() == 0 {
+		if err := writeSegmentHeader(fd, cipherID); err != nil {
+			return nil, err
+		}
+		if err := preallocate(fd, int64(segmentHeaderSize)+segmentSize); err != nil {
+			return nil, fmt.Errorf("preallocate segment file %d%s failed: %v", id, extName, err)
+		}
+	} else {
+		headerCipherID, err = readSegmentHeader(fd)
+		if err != nil {
+			return nil, fmt.Errorf("read header of segment file %d%s failed: %v", id, extName, err)
+		}
+		var kind CorruptionKind
+		currentBlockNumber, currentBlockSize, kind, err = scanUsedSize(fd, info.Size())
+		if err != nil {
+			return nil, fmt.Errorf("recover write position of segment file %d%s failed: %v", id, extName, err)
+		}
+		if kind != corruptionNone {
+			if !repairOnOpen {
+				return nil, fmt.Errorf("wal: segment file %d%s has a corrupt chunk at block %d offset %d: %w",
+					id, extName, currentBlockNumber, currentBlockSize, ErrInvalidCRC)
+			}
+			if err := repairSegmentFile(fd, currentBlockNumber, currentBlockSize, segmentSize); err != nil {
+				return nil, fmt.Errorf("repair segment file %d%s failed: %v", id, extName, err)
+			}
+		}
+	}
+
+	seg := &segment{
 		id:                 id,
 		fd:                 fd,
 		header:             make([]byte, chunkHeaderSize),
-		currentBlockNumber: uint32(offset / blockSize),
-		currentBlockSize:   uint32(offset % blockSize),
+		currentBlockNumber: currentBlockNumber,
+		currentBlockSize:   currentBlockSize,
+		cipherID:           headerCipherID,
 		startupBlock: &startupBlock{
 			block:       make([]byte, blockSize),
 			blockNumber: -1,
 		},
 		isStartupTraversal: false,
-	}, nil
+	}
+
+	if mmapRead {
+		seg.enableMMap()
+	}
+
+	return seg, nil
+}
+
+// enableMMap memory-maps seg's underlying file read-only, so later reads
+// can be served as zero-copy slices into seg.mmapData instead of going
+// through blockPool. It is best-effort: if mmap isn't available
+// (unsupported platform, odd fs), readInternal just falls back to
+// ReadAt. Meant for segments that are done being written to; the active
+// segment is promoted into the mmap pool by rotateActiveSegment/
+// OpenNewActiveSegment once it stops being the active one.
+func (seg *segment) enableMMap() {
+	info, err := seg.fd.Stat()
+	if err != nil {
+		return
+	}
+	if data, err := mmapFile(seg.fd, info.Size()); err == nil {
+		seg.mmapData = data
+	}
+}
+
+// repairSegmentFile truncates fd's data region back to the chunk boundary
+// at blockNumber/blockOffset, discarding everything after it, then
+// re-preallocates the file back out to segmentSize so writes resume into
+// reserved, zeroed space exactly as if the discarded chunks had never been
+// written.
+func repairSegmentFile(fd *os.File, blockNumber, blockOffset uint32, segmentSize int64) error {
+	truncateAt := int64(segmentHeaderSize) + int64(blockNumber)*blockSize + int64(blockOffset)
+	if err := fd.Truncate(truncateAt); err != nil {
+		return err
+	}
+	if err := preallocate(fd, int64(segmentHeaderSize)+segmentSize); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// remapIfNeeded grows the segment's mmap to cover at least `required`
+// bytes of the underlying file, remapping from scratch when the file has
+// grown past what is currently mapped. In the common case the whole
+// preallocated file is already mapped at open time and this is a no-op;
+// it only does real work for segments that grew past their original
+// mapping, mirroring the remap-on-growth behavior of Prometheus's
+// persistedBlock/openMmapFile.
+func (seg *segment) remapIfNeeded(required int64) {
+	if int64(len(seg.mmapData)) >= required {
+		return
+	}
+	info, err := seg.fd.Stat()
+	if err != nil || info.Size() < required {
+		return
+	}
+	data, err := mmapFile(seg.fd, info.Size())
+	if err != nil {
+		return
+	}
+	old := seg.mmapData
+	seg.mmapData = data
+	_ = munmapFile(old)
 }
 
 // NewReader creates a new segment reader.
@@ -247,6 +512,8 @@ func (seg *segment) Sync() error {
 func (seg *segment) Remove() error {
 	if !seg.closed {
 		seg.closed = true
+		_ = munmapFile(seg.mmapData)
+		seg.mmapData = nil
 		if err := seg.fd.Close(); err != nil {
 			return err
 		}
@@ -255,12 +522,21 @@ func (seg *segment) Remove() error {
 	return os.Remove(seg.fd.Name())
 }
 
-// Close closes the segment file.
+// Close closes the segment file. Any preallocated but unwritten tail is
+// truncated away first, so a segment that is never written to again only
+// occupies its actual used size on disk.
 func (seg *segment) Close() error {
 	if seg.closed {
 		return nil
 	}
 
+	if err := seg.fd.Truncate(int64(segmentHeaderSize) + seg.Size()); err != nil {
+		return err
+	}
+
+	_ = munmapFile(seg.mmapData)
+	seg.mmapData = nil
+
 	seg.closed = true
 	return seg.fd.Close()
 }
@@ -277,7 +553,24 @@ func (seg *segment) Size() int64 {
 //
 // Each chunk has a header, and the header contains the length, type and checksum.
 // And the payload of the chunk is the real data you want to Write.
-func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteBuffer) (*ChunkPosition, error) {
+func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteBuffer, compressed bool, recordType RecordType) (*ChunkPosition, error) {
+	return seg.appendRecordChunks(data, chunkBuffer, true, true, compressed, recordType)
+}
+
+// appendRecordChunks does the work writeToBuffer always has: split data
+// into one or more on-disk chunks (Full, First, Middle, Last), padding to
+// the next block when a header wouldn't otherwise fit. writeToBuffer
+// calls it with isFirstOfRecord and isLastOfRecord both true, since it
+// gets the whole record in one go. WriteStream instead calls it once per
+// window of a large streamed value, passing isFirstOfRecord/isLastOfRecord
+// only for the very first/last window so the chunk types it emits are
+// relative to the whole logical record rather than to a single window.
+// compressed is stamped onto every physical chunk's header so the reader
+// knows, once it has reassembled the whole record, whether to decompress
+// it; data itself must already be the (possibly) compressed bytes.
+// recordType is likewise stamped onto every physical chunk so a reader can
+// tell what kind of record it just reassembled before interpreting it.
+func (seg *segment) appendRecordChunks(data []byte, chunkBuffer *bytebufferpool.ByteBuffer, isFirstOfRecord, isLastOfRecord, compressed bool, recordType RecordType) (*ChunkPosition, error) {
 	startBufferLen := chunkBuffer.Len()
 	padding := uint32(0)
 
@@ -287,13 +580,23 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 
 	// if the left block size can not hold the chunk header, padding the block
 	if seg.currentBlockSize+chunkHeaderSize >= blockSize {
-		// padding if necessary
-		if seg.currentBlockSize < blockSize {
-			p := make([]byte, blockSize-seg.currentBlockSize)
+		if remaining := blockSize - seg.currentBlockSize; remaining >= chunkHeaderSize {
+			// there's exactly enough room for a padding chunk's header
+			// (with a zero-length payload) to self-describe the gap, so
+			// write one instead of leaving it as ambiguous raw zeros.
+			seg.appendChunkBuffer(chunkBuffer, nil, ChunkTypePadding, recordType)
+			padding += chunkHeaderSize
+			seg.currentBlockNumber += 1
+			seg.currentBlockSize = 0
+		} else if remaining > 0 {
+			// not even a chunk header fits; fall back to raw zero bytes.
+			// scanUsedSize knows this residual doesn't by itself prove the
+			// log ends here, and peeks at the next block before treating
+			// it as unwritten, preallocated space.
+			p := make([]byte, remaining)
 			chunkBuffer.B = append(chunkBuffer.B, p...)
-			padding += blockSize - seg.currentBlockSize
+			padding += remaining
 
-			// a new block
 			seg.currentBlockNumber += 1
 			seg.currentBlockSize = 0
 		}
@@ -309,7 +612,19 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 	dataSize := uint32(len(data))
 	// The entire chunk can fit into the block.
 	if seg.currentBlockSize+dataSize+chunkHeaderSize <= blockSize {
-		seg.appendChunkBuffer(chunkBuffer, data, ChunkTypeFull)
+		chunkType := ChunkTypeFull
+		switch {
+		case !isFirstOfRecord && !isLastOfRecord:
+			chunkType = ChunkTypeMiddle
+		case !isFirstOfRecord:
+			chunkType = ChunkTypeLast
+		case !isLastOfRecord:
+			chunkType = ChunkTypeFirst
+		}
+		if compressed {
+			chunkType |= chunkCompressedFlag
+		}
+		seg.appendChunkBuffer(chunkBuffer, data, chunkType, recordType)
 		position.ChunkSize = dataSize + chunkHeaderSize
 	} else {
 		// If the size of the data exceeds the size of the block,
@@ -331,17 +646,23 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 				end = dataSize
 			}
 
+			isFirstPhysical := leftSize == dataSize
+			isLastPhysical := chunkSize == leftSize
+
 			// append the chunks to the buffer
 			var chunkType ChunkType
-			switch leftSize {
-			case dataSize: // First chunk
+			switch {
+			case isFirstPhysical && isFirstOfRecord:
 				chunkType = ChunkTypeFirst
-			case chunkSize: // Last chunk
+			case isLastPhysical && isLastOfRecord:
 				chunkType = ChunkTypeLast
-			default: // Middle chunk
+			default:
 				chunkType = ChunkTypeMiddle
 			}
-			seg.appendChunkBuffer(chunkBuffer, data[dataSize-leftSize:end], chunkType)
+			if compressed {
+				chunkType |= chunkCompressedFlag
+			}
+			seg.appendChunkBuffer(chunkBuffer, data[dataSize-leftSize:end], chunkType, recordType)
 
 			leftSize -= chunkSize
 			blockCount += 1
@@ -367,8 +688,11 @@ func (seg *segment) writeToBuffer(data []byte, chunkBuffer *bytebufferpool.ByteB
 	return position, nil
 }
 
-// writeAll write batch data to the segment file.
-func (seg *segment) writeAll(data [][]byte) (positions []*ChunkPosition, err error) {
+// writeAll write batch data to the segment file. compressedFlags reports,
+// per item, whether that item's payload was already compressed by the
+// caller and should carry the chunk header's compressed bit. recordType
+// is stamped onto every item in the batch.
+func (seg *segment) writeAll(data [][]byte, compressedFlags []bool, recordType RecordType) (positions []*ChunkPosition, err error) {
 	if seg.closed {
 		return nil, ErrClosed
 	}
@@ -392,21 +716,25 @@ func (seg *segment) writeAll(data [][]byte) (positions []*ChunkPosition, err err
 	var pos *ChunkPosition
 	positions = make([]*ChunkPosition, len(data))
 	for i := 0; i < len(positions); i++ {
-		pos, err = seg.writeToBuffer(data[i], chunkBuffer)
+		pos, err = seg.writeToBuffer(data[i], chunkBuffer, compressedFlags[i], recordType)
 		if err != nil {
 			return
 		}
 		positions[i] = pos
 	}
 	// write the chunk buffer to the segment file
-	if err = seg.writeChunkBuffer(chunkBuffer); err != nil {
+	writeOffset := int64(segmentHeaderSize) + int64(originBlockNumber)*blockSize + int64(originBlockSize)
+	if err = seg.writeChunkBuffer(chunkBuffer, writeOffset); err != nil {
 		return
 	}
 	return
 }
 
-// Write writes the data to the segment file.
-func (seg *segment) Write(data []byte) (pos *ChunkPosition, err error) {
+// Write writes the data to the segment file. compressed records whether
+// data has already been compressed by the caller, so it can be tagged on
+// the chunk header and decompressed transparently on Read. recordType is
+// stamped onto the chunk header too, see RecordType.
+func (seg *segment) Write(data []byte, compressed bool, recordType RecordType) (pos *ChunkPosition, err error) {
 	if seg.closed {
 		return nil, ErrClosed
 	}
@@ -426,26 +754,120 @@ func (seg *segment) Write(data []byte) (pos *ChunkPosition, err error) {
 	}()
 
 	// write all data to the chunk buffer
-	pos, err = seg.writeToBuffer(data, chunkBuffer)
+	pos, err = seg.writeToBuffer(data, chunkBuffer, compressed, recordType)
 	if err != nil {
 		return
 	}
 	// write the chunk buffer to the segment file
-	if err = seg.writeChunkBuffer(chunkBuffer); err != nil {
+	writeOffset := int64(segmentHeaderSize) + int64(originBlockNumber)*blockSize + int64(originBlockSize)
+	if err = seg.writeChunkBuffer(chunkBuffer, writeOffset); err != nil {
 		return
 	}
 
 	return
 }
 
-func (seg *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byte, chunkType ChunkType) {
+// WriteStream writes data read from r to the segment file without
+// buffering the whole value in memory, which matters for large blobs
+// such as video frames or ML tensors. r is read in blockSize windows,
+// each of which is framed through appendRecordChunks as part of one
+// logical record, so the chunk types on disk describe one record (First,
+// Middle..., Last) just as Write would. Unlike Write, a chunk can also end
+// mid-block wherever a window ends, with the next chunk following it in
+// the same block. If
+// bytesPerSync is non-zero, the pending chunk buffer is flushed and
+// synced every time it grows past that many bytes instead of only once
+// at the end, bounding how much unsynced data a slow stream can pile up.
+func (seg *segment) WriteStream(r io.Reader, bytesPerSync uint32, recordType RecordType) (pos *ChunkPosition, err error) {
+	if seg.closed {
+		return nil, ErrClosed
+	}
+
+	originBlockNumber := seg.currentBlockNumber
+	originBlockSize := seg.currentBlockSize
+	writeOffset := int64(segmentHeaderSize) + int64(originBlockNumber)*blockSize + int64(originBlockSize)
+
+	chunkBuffer := bytebufferpool.Get()
+	chunkBuffer.Reset()
+	defer func() {
+		if err != nil {
+			seg.currentBlockNumber = originBlockNumber
+			seg.currentBlockSize = originBlockSize
+		}
+		bytebufferpool.Put(chunkBuffer)
+	}()
+
+	window := getBuffer()
+	defer putBuffer(window)
+
+	readWindow := func() ([]byte, error) {
+		n, rerr := io.ReadFull(r, window)
+		if rerr == io.ErrUnexpectedEOF {
+			rerr = io.EOF
+		}
+		if rerr != nil && rerr != io.EOF {
+			return nil, rerr
+		}
+		return window[:n], rerr
+	}
+
+	flush := func() error {
+		if chunkBuffer.Len() == 0 {
+			return nil
+		}
+		if werr := seg.writeChunkBuffer(chunkBuffer, writeOffset); werr != nil {
+			return werr
+		}
+		writeOffset += int64(chunkBuffer.Len())
+		chunkBuffer.Reset()
+		if bytesPerSync > 0 {
+			return seg.fd.Sync()
+		}
+		return nil
+	}
+
+	curData, readErr := readWindow()
+	first := true
+	for {
+		isLast := readErr == io.EOF
+		var chunkPos *ChunkPosition
+		chunkPos, err = seg.appendRecordChunks(curData, chunkBuffer, first, isLast, false, recordType)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			pos = chunkPos
+			first = false
+		} else {
+			pos.ChunkSize += chunkPos.ChunkSize
+		}
+		if isLast {
+			break
+		}
+		if bytesPerSync > 0 && uint32(chunkBuffer.Len()) >= bytesPerSync {
+			if err = flush(); err != nil {
+				return nil, err
+			}
+		}
+		curData, readErr = readWindow()
+	}
+
+	if err = flush(); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+func (seg *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byte, chunkType ChunkType, recordType RecordType) {
 	// Length	2 Bytes	index:4-5
 	binary.LittleEndian.PutUint16(seg.header[4:6], uint16(len(data)))
 	// Type	1 Byte	index:6
 	seg.header[6] = chunkType
+	// RecordType	1 Byte	index:7
+	seg.header[7] = recordType
 	// Checksum	4 Bytes index:0-3
-	sum := crc32.ChecksumIEEE(seg.header[4:])
-	sum = crc32.Update(sum, crc32.IEEETable, data)
+	sum := crc32.Checksum(seg.header[4:], crc32cTable)
+	sum = crc32.Update(sum, crc32cTable, data)
 	binary.LittleEndian.PutUint32(seg.header[:4], sum)
 
 	// append the header and data to segment chunk buffer
@@ -453,14 +875,18 @@ func (seg *segment) appendChunkBuffer(buf *bytebufferpool.ByteBuffer, data []byt
 	buf.B = append(buf.B, data...)
 }
 
-// write the pending chunk buffer to the segment file
-func (seg *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer) error {
+// writeChunkBuffer writes the pending chunk buffer to the segment file at
+// offset, which is the logical write position (including the segment
+// header) captured before writeToBuffer advanced the segment's cursor.
+// Segments are preallocated up front, so writes land at an explicit
+// offset via WriteAt rather than relying on O_APPEND.
+func (seg *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer, offset int64) error {
 	if seg.currentBlockSize > blockSize {
 		return errors.New("the current block size exceeds the maximum block size")
 	}
 
 	// write the data into underlying file
-	if _, err := seg.fd.Write(buf.Bytes()); err != nil {
+	if _, err := seg.fd.WriteAt(buf.Bytes(), offset); err != nil {
 		return err
 	}
 
@@ -469,33 +895,99 @@ func (seg *segment) writeChunkBuffer(buf *bytebufferpool.ByteBuffer) error {
 	return nil
 }
 
-// Read reads the data from the segment file by the block number and chunk offset.
-func (seg *segment) Read(blockNumber uint32, chunkOffset int64) ([]byte, error) {
-	value, _, err := seg.readInternal(blockNumber, chunkOffset)
-	return value, err
+// overwriteChunk replaces the on-disk payload of the chunk at pos with
+// newPayload, which must be exactly as long as the original reassembled
+// payload, and recomputes each affected chunk's checksum in place.
+// Block/chunk boundaries are left untouched, so this only works when the
+// replacement has the same length as the original, e.g. Rewrap swapping a
+// ciphertext for one produced by a different key under the same AEAD tag
+// size.
+func (seg *segment) overwriteChunk(pos *ChunkPosition, newPayload []byte) error {
+	if seg.closed {
+		return ErrClosed
+	}
+
+	var (
+		blockNumber = pos.BlockNumber
+		chunkOffset = pos.ChunkOffset
+		segSize     = seg.Size()
+		left        = newPayload
+		block       = make([]byte, blockSize)
+	)
+
+	for {
+		size := int64(blockSize)
+		fileOffset := int64(segmentHeaderSize) + int64(blockNumber)*blockSize
+		if size+int64(blockNumber)*blockSize > segSize {
+			size = segSize - int64(blockNumber)*blockSize
+		}
+
+		if _, err := seg.fd.ReadAt(block[0:size], fileOffset); err != nil {
+			return err
+		}
+
+		header := block[chunkOffset : chunkOffset+chunkHeaderSize]
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		chunkType := header[6]
+
+		if length > int64(len(left)) {
+			return fmt.Errorf("wal: rewrap payload shorter than original chunk")
+		}
+		payloadStart := chunkOffset + chunkHeaderSize
+		copy(block[payloadStart:payloadStart+length], left[:length])
+		left = left[length:]
+
+		sum := crc32.Checksum(header[4:], crc32cTable)
+		sum = crc32.Update(sum, crc32cTable, block[payloadStart:payloadStart+length])
+		binary.LittleEndian.PutUint32(header[:4], sum)
+
+		if _, err := seg.fd.WriteAt(block[chunkOffset:payloadStart+length], fileOffset+chunkOffset); err != nil {
+			return err
+		}
+
+		if baseChunkType(chunkType) == ChunkTypeFull || baseChunkType(chunkType) == ChunkTypeLast {
+			break
+		}
+		blockNumber++
+		chunkOffset = 0
+	}
+	if len(left) != 0 {
+		return fmt.Errorf("wal: rewrap payload longer than original chunk")
+	}
+	return nil
+}
+
+// Read reads the data from the segment file by the block number and chunk
+// offset. The second return value reports whether the stored payload was
+// compressed, so callers can decompress after decrypting it.
+func (seg *segment) Read(blockNumber uint32, chunkOffset int64) ([]byte, bool, error) {
+	value, compressed, _, _, err := seg.readInternal(blockNumber, chunkOffset)
+	return value, compressed, err
 }
 
-func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte, *ChunkPosition, error) {
+func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte, bool, RecordType, *ChunkPosition, error) {
 	if seg.closed {
-		return nil, nil, ErrClosed
+		return nil, false, 0, nil, ErrClosed
 	}
 
 	var (
-		result    []byte
-		block     []byte
-		segSize   = seg.Size()
-		nextChunk = &ChunkPosition{SegmentId: seg.id}
+		result     []byte
+		fallback   []byte
+		compressed bool
+		recordType RecordType
+		segSize    = seg.Size()
+		nextChunk  = &ChunkPosition{SegmentId: seg.id}
 	)
 
-	if seg.isStartupTraversal {
-		block = seg.startupBlock.block
-	} else {
-		block = getBuffer()
-		if len(block) != blockSize {
-			block = make([]byte, blockSize)
+	// fallback is only allocated (and only returned to blockPool) if mmap
+	// isn't available or hasn't caught up for some block along the way;
+	// when every block is served from mmapData this never runs, which is
+	// what lets mmap'd segments skip the startupBlock reuse trick too.
+	defer func() {
+		if fallback != nil && !seg.isStartupTraversal {
+			putBuffer(fallback)
 		}
-		defer putBuffer(block)
-	}
+	}()
 
 	for {
 		size := int64(blockSize)
@@ -505,27 +997,50 @@ func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte,
 		}
 
 		if chunkOffset >= size {
-			return nil, nil, io.EOF
-		}
-
-		if seg.isStartupTraversal {
-			// There are two cases that we should read block from file:
-			// 1. the acquired block is not the cached one
-			// 2. new writes appended to the block, and the block
-			// is still smaller than 32KB, we must read it again because of the new writes.
-			if seg.startupBlock.blockNumber != int64(blockNumber) || size != blockSize {
-				// read block from segment file at the specified offset.
-				_, err := seg.fd.ReadAt(block[0:size], offset)
-				if err != nil {
-					return nil, nil, err
+			return nil, false, 0, nil, io.EOF
+		}
+
+		fileOffset := int64(segmentHeaderSize) + offset
+		if seg.mmapData != nil {
+			seg.remapIfNeeded(fileOffset + size)
+		}
+
+		var block []byte
+		if seg.mmapData != nil && int64(len(seg.mmapData)) >= fileOffset+size {
+			// zero-copy: slice straight into the mapped region instead of
+			// going through blockPool.
+			block = seg.mmapData[fileOffset : fileOffset+size]
+		} else {
+			if fallback == nil {
+				if seg.isStartupTraversal {
+					fallback = seg.startupBlock.block
+				} else {
+					fallback = getBuffer()
+					if len(fallback) != blockSize {
+						fallback = make([]byte, blockSize)
+					}
 				}
-				// remember the block
-				seg.startupBlock.blockNumber = int64(blockNumber)
 			}
-		} else {
-			if _, err := seg.fd.ReadAt(block[0:size], offset); err != nil {
-				return nil, nil, err
+			if seg.isStartupTraversal {
+				// There are two cases that we should read block from file:
+				// 1. the acquired block is not the cached one
+				// 2. new writes appended to the block, and the block
+				// is still smaller than 32KB, we must read it again because of the new writes.
+				if seg.startupBlock.blockNumber != int64(blockNumber) || size != blockSize {
+					// read block from segment file at the specified offset.
+					_, err := seg.fd.ReadAt(fallback[0:size], fileOffset)
+					if err != nil {
+						return nil, false, 0, nil, err
+					}
+					// remember the block
+					seg.startupBlock.blockNumber = int64(blockNumber)
+				}
+			} else {
+				if _, err := seg.fd.ReadAt(fallback[0:size], fileOffset); err != nil {
+					return nil, false, 0, nil, err
+				}
 			}
+			block = fallback[:size]
 		}
 
 		// header
@@ -540,16 +1055,20 @@ func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte,
 
 		// check sum
 		checksumEnd := chunkOffset + chunkHeaderSize + int64(length)
-		checksum := crc32.ChecksumIEEE(block[chunkOffset+4 : checksumEnd])
+		checksum := crc32.Checksum(block[chunkOffset+4:checksumEnd], crc32cTable)
 		savedSum := binary.LittleEndian.Uint32(header[:4])
 		if savedSum != checksum {
-			return nil, nil, ErrInvalidCRC
+			return nil, false, 0, nil, ErrInvalidCRC
 		}
 
 		// type
 		chunkType := header[6]
+		if chunkType&chunkCompressedFlag != 0 {
+			compressed = true
+		}
+		recordType = header[7]
 
-		if chunkType == ChunkTypeFull || chunkType == ChunkTypeLast {
+		if baseChunkType(chunkType) == ChunkTypeFull || baseChunkType(chunkType) == ChunkTypeLast {
 			nextChunk.BlockNumber = blockNumber
 			nextChunk.ChunkOffset = checksumEnd
 			// If this is the last chunk in the block, and the left block
@@ -560,18 +1079,154 @@ func (seg *segment) readInternal(blockNumber uint32, chunkOffset int64) ([]byte,
 			}
 			break
 		}
-		blockNumber += 1
-		chunkOffset = 0
+		// not the record's last physical chunk - WriteStream's windowed
+		// writes can leave a First/Middle chunk ending mid-block (a
+		// window boundary need not line up with a block boundary), so
+		// the next chunk may continue right after it in the same block
+		// rather than at the start of the next one; only advance blocks
+		// when there's no room left here for another header.
+		if checksumEnd+chunkHeaderSize <= blockSize {
+			chunkOffset = checksumEnd
+		} else {
+			blockNumber += 1
+			chunkOffset = 0
+		}
+	}
+	return result, compressed, recordType, nextChunk, nil
+}
+
+// segmentStreamReader implements io.ReadCloser over a chunked record,
+// the counterpart to WriteStream: it fetches one block at a time into a
+// buffer borrowed from blockPool instead of assembling the whole record
+// in memory the way Read does.
+type segmentStreamReader struct {
+	seg         *segment
+	blockNumber uint32
+	chunkOffset int64
+	block       []byte
+	blockValid  int
+	loadedBlock int64
+	pending     []byte
+	done        bool
+}
+
+// OpenReader returns an io.ReadCloser that streams the record at pos
+// back out block by block. The caller must Close it to return the
+// pooled block buffer.
+func (seg *segment) OpenReader(pos ChunkPosition) io.ReadCloser {
+	return &segmentStreamReader{
+		seg:         seg,
+		blockNumber: pos.BlockNumber,
+		chunkOffset: pos.ChunkOffset,
+		block:       getBuffer(),
+		loadedBlock: -1,
+	}
+}
+
+// loadBlock fetches blockNumber into r.block if it isn't already cached
+// there. blockValid tracks how many of r.block's bytes actually hold
+// data (the segment's final block may be shorter than blockSize), so the
+// buffer itself is never resliced and can always go back to blockPool
+// at its original capacity.
+func (r *segmentStreamReader) loadBlock(blockNumber uint32) error {
+	if r.loadedBlock == int64(blockNumber) {
+		return nil
+	}
+	segSize := r.seg.Size()
+	offset := int64(blockNumber) * blockSize
+	if offset >= segSize {
+		return io.EOF
+	}
+	size := int64(blockSize)
+	if offset+size > segSize {
+		size = segSize - offset
+	}
+	fileOffset := int64(segmentHeaderSize) + offset
+	if _, err := r.seg.fd.ReadAt(r.block[:size], fileOffset); err != nil {
+		return err
+	}
+	r.blockValid = int(size)
+	r.loadedBlock = int64(blockNumber)
+	return nil
+}
+
+// Read implements io.Reader, returning the reconstructed record's
+// payload one chunk at a time, verifying each chunk's CRC as it goes.
+func (r *segmentStreamReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.seg.closed {
+		return 0, ErrClosed
+	}
+
+	if err := r.loadBlock(r.blockNumber); err != nil {
+		return 0, err
+	}
+	block := r.block[:r.blockValid]
+	if int(r.chunkOffset)+chunkHeaderSize > len(block) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	header := block[r.chunkOffset : r.chunkOffset+chunkHeaderSize]
+	length := int64(binary.LittleEndian.Uint16(header[4:6]))
+	start := r.chunkOffset + chunkHeaderSize
+	end := start + length
+	if int(end) > len(block) {
+		return 0, io.ErrUnexpectedEOF
 	}
-	return result, nextChunk, nil
+	payload := block[start:end]
+
+	checksum := crc32.Checksum(header[4:], crc32cTable)
+	checksum = crc32.Update(checksum, crc32cTable, payload)
+	if binary.LittleEndian.Uint32(header[:4]) != checksum {
+		return 0, ErrInvalidCRC
+	}
+
+	chunkType := header[6]
+	if baseChunkType(chunkType) == ChunkTypeFull || baseChunkType(chunkType) == ChunkTypeLast {
+		r.done = true
+	} else if r.chunkOffset+int64(chunkHeaderSize)+length+chunkHeaderSize <= blockSize {
+		// the next chunk continues right after this one in the same
+		// block - a window boundary in WriteStream need not line up
+		// with a block boundary, so this Middle/First chunk may not
+		// reach all the way to blockSize (see readInternal's identical
+		// continuation check).
+		r.chunkOffset += int64(chunkHeaderSize) + length
+	} else {
+		r.blockNumber++
+		r.chunkOffset = 0
+	}
+
+	n := copy(p, payload)
+	if n < len(payload) {
+		r.pending = append(r.pending[:0], payload[n:]...)
+	}
+	return n, nil
+}
+
+// Close returns the reader's block buffer to blockPool.
+func (r *segmentStreamReader) Close() error {
+	if r.block != nil {
+		putBuffer(r.block)
+		r.block = nil
+	}
+	return nil
 }
 
-// Next returns the Next chunk data.
+// Next returns the Next chunk data. The third return value reports
+// whether the payload was stored compressed, so callers can decompress
+// it after any cipher decryption; the fourth reports its RecordType.
 // You can call it repeatedly until io.EOF is returned.
-func (segReader *segmentReader) Next() ([]byte, *ChunkPosition, error) {
+func (segReader *segmentReader) Next() ([]byte, bool, RecordType, *ChunkPosition, error) {
 	// The segment file is closed
 	if segReader.segment.closed {
-		return nil, nil, ErrClosed
+		return nil, false, 0, nil, ErrClosed
 	}
 
 	// this position describes the current chunk info
@@ -581,12 +1236,12 @@ func (segReader *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 		ChunkOffset: segReader.chunkOffset,
 	}
 
-	value, nextChunk, err := segReader.segment.readInternal(
+	value, compressed, recordType, nextChunk, err := segReader.segment.readInternal(
 		segReader.blockNumber,
 		segReader.chunkOffset,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, 0, nil, err
 	}
 
 	// Calculate the chunk size.
@@ -600,7 +1255,127 @@ func (segReader *segmentReader) Next() ([]byte, *ChunkPosition, error) {
 	segReader.blockNumber = nextChunk.BlockNumber
 	segReader.chunkOffset = nextChunk.ChunkOffset
 
-	return value, chunkPosition, nil
+	return value, compressed, recordType, chunkPosition, nil
+}
+
+// readChunkHeader reads just the fixed-size chunk header at the given
+// block/offset, without fetching its payload.
+func (seg *segment) readChunkHeader(blockNumber uint32, chunkOffset int64) ([]byte, error) {
+	header := make([]byte, chunkHeaderSize)
+	fileOffset := int64(segmentHeaderSize) + int64(blockNumber)*blockSize + chunkOffset
+	n, err := seg.fd.ReadAt(header, fileOffset)
+	if err != nil {
+		return nil, err
+	}
+	if n != chunkHeaderSize {
+		return nil, io.EOF
+	}
+	return header, nil
+}
+
+// verifyChunkHeaderCRC reads the payload described by header at
+// blockNumber/chunkOffset and verifies its checksum, without assembling a
+// full (possibly multi-chunk) record.
+func (seg *segment) verifyChunkHeaderCRC(blockNumber uint32, chunkOffset int64, header []byte) error {
+	length := int64(binary.LittleEndian.Uint16(header[4:6]))
+	payload := make([]byte, length)
+	fileOffset := int64(segmentHeaderSize) + int64(blockNumber)*blockSize + chunkOffset + chunkHeaderSize
+	if _, err := seg.fd.ReadAt(payload, fileOffset); err != nil {
+		return err
+	}
+	checksum := crc32.Checksum(header[4:], crc32cTable)
+	checksum = crc32.Update(checksum, crc32cTable, payload)
+	if binary.LittleEndian.Uint32(header[:4]) != checksum {
+		return ErrInvalidCRC
+	}
+	return nil
+}
+
+// Seek moves the reader to the chunk boundary at or after the given byte
+// offset into the segment's data region (i.e. not counting the segment
+// header), and resumes Next() from there. This unlocks range scans and
+// parallel recovery over large WALs without replaying from offset 0.
+//
+// If pos lands where a chunk header could not fit before the next block
+// boundary, it must be inside the padding writeToBuffer inserts there, so
+// Seek advances straight to the next block — mirroring the boundary fix
+// in Riegeli's reader. The CRC of the landing chunk is verified, and if
+// its type is Middle or Last, Seek steps back one block at a time and
+// stops at the first earlier block whose opening chunk (at offset 0) is a
+// First or Full header, so the reader resumes on a coherent record. That
+// block need not hold the nearest First/Full header: Seek does not look
+// at chunks past offset 0 while stepping back, so it can resume at an
+// earlier record and Next then also returns records that start before
+// pos.
+func (segReader *segmentReader) Seek(pos int64) error {
+	if segReader.segment.closed {
+		return ErrClosed
+	}
+	if pos < 0 {
+		return fmt.Errorf("wal: negative seek position %d", pos)
+	}
+
+	blockNumber := uint32(pos / blockSize)
+	target := pos % blockSize
+	if blockSize-target < chunkHeaderSize {
+		blockNumber++
+		target = 0
+	}
+
+	// walk forward from the start of the block, chunk by chunk, to find
+	// the first chunk boundary at or after target.
+	landingOffset := int64(0)
+	for landingOffset < target {
+		header, err := segReader.segment.readChunkHeader(blockNumber, landingOffset)
+		if err != nil {
+			return err
+		}
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		next := landingOffset + chunkHeaderSize + length
+		if blockSize-next < chunkHeaderSize {
+			// the rest of the block is padding; nothing at/after target
+			// lives here, move on to the next block.
+			blockNumber++
+			landingOffset = 0
+			target = 0
+			continue
+		}
+		landingOffset = next
+	}
+
+	header, err := segReader.segment.readChunkHeader(blockNumber, landingOffset)
+	if err != nil {
+		return err
+	}
+	if err := segReader.segment.verifyChunkHeaderCRC(blockNumber, landingOffset, header); err != nil {
+		return err
+	}
+
+	// back up to the nearest First/Full header if we landed inside a
+	// continuation fragment, so Next() returns a coherent record.
+	for baseChunkType(header[6]) == ChunkTypeMiddle || baseChunkType(header[6]) == ChunkTypeLast {
+		if blockNumber == 0 {
+			return fmt.Errorf("wal: corrupt segment, continuation chunk has no preceding First header")
+		}
+		blockNumber--
+		landingOffset = 0
+		header, err = segReader.segment.readChunkHeader(blockNumber, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	segReader.blockNumber = blockNumber
+	segReader.chunkOffset = landingOffset
+	return nil
+}
+
+// SeekToChunk moves the reader directly to a previously obtained
+// ChunkPosition, skipping the boundary search Seek performs. Useful when
+// the exact position is already known, e.g. from an earlier Next() call.
+func (segReader *segmentReader) SeekToChunk(pos ChunkPosition) {
+	segReader.blockNumber = pos.BlockNumber
+	segReader.chunkOffset = pos.ChunkOffset
 }
 
 // Encode encodes the chunk position to a byte slice.
@@ -630,8 +1405,6 @@ func (cp *ChunkPosition) encode(shrink bool) []byte {
 	index += binary.PutUvarint(buf[index:], uint64(cp.ChunkOffset))
 	// ChunkSize
 	index += binary.PutUvarint(buf[index:], uint64(cp.ChunkSize))
-	// ValueNum
-	index += binary.PutUvarint(buf[index:], uint64(cp.ValueNum))
 
 	if shrink {
 		return buf[:index]
@@ -659,15 +1432,11 @@ func DecodeChunkPosition(buf []byte) *ChunkPosition {
 	// ChunkSize
 	chunkSize, n := binary.Uvarint(buf[index:])
 	index += n
-	// ValueNum
-	ValueNum, n := binary.Uvarint(buf[index:])
-	index += n
 
 	return &ChunkPosition{
 		SegmentId:   uint32(segmentId),
 		BlockNumber: uint32(blockNumber),
 		ChunkOffset: int64(chunkOffset),
 		ChunkSize:   uint32(chunkSize),
-		ValueNum:    int64(ValueNum),
 	}
 }
@@ -0,0 +1,25 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the first size bytes of fd read-only, MAP_SHARED so that
+// writes made through fd.WriteAt (the only way segment files are ever
+// written to) remain visible through the mapping without an explicit
+// remap, since both go through the same page cache.
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(fd.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// munmapFile releases a mapping previously returned by mmapFile.
+func munmapFile(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return unix.Munmap(data)
+}
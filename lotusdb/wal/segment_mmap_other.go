@@ -0,0 +1,20 @@
+//go:build !linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+// errMMapUnsupported is returned by mmapFile on platforms this build has
+// no mmap implementation for, so callers fall back to the ReadAt path.
+var errMMapUnsupported = errors.New("wal: mmap is not supported on this platform")
+
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	return nil, errMMapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
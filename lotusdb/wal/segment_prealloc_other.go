@@ -0,0 +1,16 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// preallocate reserves size bytes for fd. Platforms without a fallocate
+// equivalent fall back to a plain truncate, which still reserves the
+// logical size (as a sparse file) even where the filesystem doesn't
+// allocate the extent eagerly.
+func preallocate(fd *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return fd.Truncate(size)
+}